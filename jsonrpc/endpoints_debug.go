@@ -8,7 +8,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
+	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -35,6 +36,89 @@ var defaultTraceConfig = &traceConfig{
 type DebugEndpoints struct {
 	state types.StateInterface
 	txMan dbTxManager
+
+	// chainTraceWorkers caps the number of concurrent workers used by
+	// TraceChain. When zero it defaults to runtime.NumCPU().
+	chainTraceWorkers int
+
+	// maxTraceChainBlocks caps how many blocks a single TraceChain call
+	// may span. When zero it defaults to defaultMaxTraceChainBlocks. This
+	// bounds the size of the []traceChainEvent slice TraceChain has to
+	// hold in memory at once, since the response is still returned as one
+	// synchronous JSON-RPC result.
+	maxTraceChainBlocks uint64
+
+	// batchTraceWorkers caps the number of concurrent workers used by
+	// TraceBatchByNumber when tracing in-process. When zero it defaults
+	// to runtime.NumCPU().
+	batchTraceWorkers int
+
+	// traceBatchSelfFanout, when true, makes TraceBatchByNumber recover
+	// its legacy behavior of redirecting each trace transaction request
+	// back through the balancer instead of tracing in-process.
+	traceBatchSelfFanout bool
+
+	// fallbackClient, when set, lets trace requests this node can't
+	// serve locally be proxied to an upstream archive/tracing node.
+	fallbackClient *debugFallbackConfig
+}
+
+// debugFallbackConfig configures an optional upstream JSON-RPC node that
+// debug_trace* requests are proxied to when this node can't produce a
+// trace itself: pruned state or an unknown tx hash, and for debug_traceCall
+// also a tracer the executor doesn't support. debug_traceTransaction is not
+// proxied when the executor rejects its tracer.
+type debugFallbackConfig struct {
+	// URL is the upstream jRPC endpoint, e.g. a dedicated archive node.
+	URL string
+	// AllowedMethods lists the debug_trace* methods that are allowed to
+	// fall back to URL on a local failure. A method missing from this list
+	// is not proxied on a local failure; requests matched by PinnedTracers
+	// are proxied whether or not their method is listed here.
+	AllowedMethods []string
+	// PinnedTracers forces specific tracers of a method straight to the
+	// fallback, regardless of local availability, e.g.
+	// {"debug_traceCall": {"prestateTracer"}}. A method present here with
+	// an empty tracer list pins every request for that method.
+	PinnedTracers map[string][]string
+}
+
+// allowsMethod reports whether method is allowed to use the fallback
+// client at all.
+func (c *debugFallbackConfig) allowsMethod(method string) bool {
+	if c == nil {
+		return false
+	}
+	for _, m := range c.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// isPinned reports whether requests for method using the given tracer
+// must always be proxied to the fallback, bypassing the local executor.
+func (c *debugFallbackConfig) isPinned(method string, tracer *string) bool {
+	if c == nil {
+		return false
+	}
+	tracers, ok := c.PinnedTracers[method]
+	if !ok {
+		return false
+	}
+	if len(tracers) == 0 {
+		return true
+	}
+	if tracer == nil {
+		return false
+	}
+	for _, t := range tracers {
+		if t == *tracer {
+			return true
+		}
+	}
+	return false
 }
 
 type traceConfig struct {
@@ -44,6 +128,46 @@ type traceConfig struct {
 	EnableReturnData bool            `json:"enableReturnData"`
 	Tracer           *string         `json:"tracer"`
 	TracerConfig     json.RawMessage `json:"tracerConfig"`
+	// Timeout bounds how long the trace may run, e.g. "5s". When unset
+	// the trace can still be aborted early via ctx cancellation, but has
+	// no deadline of its own.
+	Timeout *string `json:"timeout"`
+	// Reexec hints how many blocks of history the executor is allowed to
+	// replay to reconstruct the state needed for this trace.
+	Reexec *uint64 `json:"reexec"`
+}
+
+// withTraceTimeout wraps ctx with the deadline described by cfg.Timeout, if
+// any. When no error is returned, the caller must call the returned cancel
+// func; on error the cancel func is nil. The
+// returned *time.Duration is the deadline actually applied (nil when
+// cfg.Timeout was unset), so a later context.DeadlineExceeded can be
+// reported accurately without re-reading a config field that may be nil —
+// ctx can still expire on its own (a parent deadline, a disconnecting
+// client) even when no per-request timeout was requested.
+func withTraceTimeout(ctx context.Context, cfg *traceConfig) (context.Context, context.CancelFunc, *time.Duration, types.Error) {
+	if cfg == nil || cfg.Timeout == nil || *cfg.Timeout == "" {
+		return ctx, func() {}, nil, nil
+	}
+
+	timeout, err := time.ParseDuration(*cfg.Timeout)
+	if err != nil {
+		return nil, nil, nil, types.NewRPCError(types.DefaultErrorCode, fmt.Sprintf("invalid timeout %q: %v", *cfg.Timeout, err))
+	}
+
+	tracedCtx, cancel := context.WithTimeout(ctx, timeout)
+	return tracedCtx, cancel, &timeout, nil
+}
+
+// traceTimeoutErrorMessage builds the error message for a trace that hit
+// context.DeadlineExceeded, reporting the configured duration when one was
+// requested and falling back to a generic message when the deadline came
+// from somewhere else (e.g. the ambient request context).
+func traceTimeoutErrorMessage(timeout *time.Duration) string {
+	if timeout == nil {
+		return "trace timed out"
+	}
+	return fmt.Sprintf("trace timed out after %v", *timeout)
 }
 
 // StructLogRes represents the debug trace information for each opcode
@@ -73,7 +197,8 @@ type traceBlockTransactionResponse struct {
 
 type traceBatchTransactionResponse struct {
 	TxHash common.Hash `json:"txHash"`
-	Result interface{} `json:"result"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
 }
 
 // TraceTransaction creates a response for debug_traceTransaction request.
@@ -129,44 +254,522 @@ func (d *DebugEndpoints) TraceBlockByHash(hash types.ArgHash, cfg *traceConfig)
 	})
 }
 
-// TraceBatchByNumber creates a response for debug_traceBatchByNumber request.
-// this endpoint tries to help clients to get traces at once for all the transactions
-// attached to the same batch.
+// TraceCall (debug_traceCall) lives in endpoints_debug_tracecall.go behind
+// the zkevm_debug_tracecall build tag: it depends on state-layer symbols
+// (state.DebugTraceCall, state.OverrideAccount, state.BlockOverrides,
+// state.ErrUnsupportedTracer, and Reexec/JSHooks/Stop on state.TraceConfig)
+// that don't exist in the state package yet, and a default build of this
+// package must keep compiling without them. Build with that tag once the
+// companion state-layer change lands.
+
+// traceChainEvent is a single trace emitted by TraceChain, carrying enough
+// information for the caller to attribute it back to the block and
+// transaction it belongs to.
+type traceChainEvent struct {
+	BlockNumber types.ArgUint64 `json:"blockNumber"`
+	TxHash      common.Hash     `json:"txHash"`
+	Result      interface{}     `json:"result"`
+}
+
+// traceChainJob is one unit of work handed to a TraceChain worker.
+type traceChainJob struct {
+	blockNumber uint64
+	txIndex     int
+	tx          *ethTypes.Transaction
+}
+
+// traceChainJobResult is what a TraceChain worker hands back to the
+// reassembler for a single traceChainJob.
+type traceChainJobResult struct {
+	blockNumber uint64
+	txIndex     int
+	txHash      common.Hash
+	result      interface{}
+	err         types.Error
+}
+
+// boundedWorkerCount picks how many workers a trace worker pool should use:
+// configured if positive, otherwise runtime.NumCPU(); then, when maxTasks is
+// positive, clamped so a small batch never starts more workers than it has
+// tasks for. A maxTasks of 0 leaves the result unclamped, for pools (like
+// TraceChain's) that are sized against an unknown amount of future work
+// rather than a fixed task count known up front.
+func boundedWorkerCount(configured, maxTasks int) int {
+	workerCount := configured
+	if workerCount <= 0 {
+		workerCount = runtime.NumCPU()
+	}
+	if maxTasks > 0 && workerCount > maxTasks {
+		workerCount = maxTasks
+	}
+	return workerCount
+}
+
+// defaultTraceChainJobBuffer bounds how many pending jobs/results can sit in
+// the channels at once, so a large [start, end] range doesn't load every
+// block into memory up front.
+const defaultTraceChainJobBuffer = 64
+
+// defaultMaxTraceChainBlocks is the default value of maxTraceChainBlocks.
+// TraceChain still returns its response as a single JSON-RPC result rather
+// than an RPC subscription or chunked NDJSON stream, so this bounds the
+// []traceChainEvent slice it has to hold in memory for the response; it's
+// the de facto replacement for true response streaming until the jsonrpc
+// server this endpoint is registered against supports a streaming transport.
+const defaultMaxTraceChainBlocks = 10000
+
+// TraceChain traces every transaction in the [start, end] range of L2
+// blocks and returns the results in block order. Like TraceBatchByNumber's
+// default mode, TraceChain parallelizes in-process with a bounded worker
+// pool, here across a whole block range, so large ranges don't
+// have to be materialized by a single goroutine, and honors ctx
+// cancellation so a disconnecting client stops in-flight executor work.
 //
-// IMPORTANT: in order to take advantage of the infrastructure automatically scaling,
-// instead of parallelizing the trace transaction internally and pushing all the load
-// to a single jRPC and Executor instance, the code will redirect the trace transaction
-// requests to the same url, making them external calls, so we can process in parallel
-// with multiple jRPC and Executor instances.
+// The range is capped at maxTraceChainBlocks (defaultMaxTraceChainBlocks
+// when unset): the internal pipeline emits events one at a time as soon as
+// they're in order, but this method still has to collect them into one
+// slice for the synchronous JSON-RPC response, so the cap is what actually
+// keeps a huge range from exhausting memory.
+// See https://geth.ethereum.org/docs/interacting-with-geth/rpc/ns-debug#debugtracechain
+func (d *DebugEndpoints) TraceChain(start, end types.BlockNumber, cfg *traceConfig) (interface{}, types.Error) {
+	return d.txMan.NewDbTxScope(d.state, func(ctx context.Context, dbTx pgx.Tx) (interface{}, types.Error) {
+		startNumber, rpcErr := start.GetNumericBlockNumber(ctx, d.state, dbTx)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+
+		endNumber, rpcErr := end.GetNumericBlockNumber(ctx, d.state, dbTx)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+
+		if endNumber < startNumber {
+			return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("end block #%d is before start block #%d", endNumber, startNumber), nil)
+		}
+
+		maxBlocks := d.maxTraceChainBlocks
+		if maxBlocks == 0 {
+			maxBlocks = defaultMaxTraceChainBlocks
+		}
+		if endNumber-startNumber+1 > maxBlocks {
+			return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("range of %d blocks exceeds the maximum of %d blocks per debug_traceChain call", endNumber-startNumber+1, maxBlocks), nil)
+		}
+
+		return d.traceChain(ctx, startNumber, endNumber, cfg)
+	})
+}
+
+// traceChain runs the producer/worker-pool/reassembler pipeline described
+// on TraceChain and returns the ordered []traceChainEvent. It collects
+// every event from runTraceChainPipeline into a slice for the synchronous
+// JSON-RPC response, which is what maxTraceChainBlocks actually bounds.
+func (d *DebugEndpoints) traceChain(ctx context.Context, start, end uint64, cfg *traceConfig) (interface{}, types.Error) {
+	events := make([]traceChainEvent, 0)
+	rpcErr := d.runTraceChainPipeline(ctx, start, end, cfg, func(event traceChainEvent) {
+		events = append(events, event)
+	})
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	return events, nil
+}
+
+// runTraceChainPipeline runs the producer/worker-pool/reassembler pipeline
+// over the [start, end] range of L2 blocks, invoking emit once per event in
+// block/tx order. It derives its own cancellable context for the pipeline
+// so that returning early (e.g. on the first per-tx error, or ctx being
+// cancelled) stops produceTraceChainJobs and every
+// traceChainWorker promptly instead of leaving them running until the
+// caller's ctx happens to expire on its own.
 //
-// the request flow will work as follows:
-// -> user do a trace batch request
-// -> jRPC balancer picks a jRPC server to handle the trace batch request
-// -> picked jRPC sends parallel trace transaction requests for each transaction in the batch
-// -> jRPC balancer sends each request to a different jRPC to handle the trace transaction requests
-// -> picked jRPC server group trace transaction responses from other jRPC servers
-// -> picked jRPC respond the initial request to the user with all the tx traces
-func (d *DebugEndpoints) TraceBatchByNumber(httpRequest *http.Request, number types.BatchNumber, cfg *traceConfig) (interface{}, types.Error) {
-	// timeout is the maximum time the code will wait for all the
-	// traces to be loaded from the jRPC and added to the responses
-	const timeout = 10 * time.Minute
+// This is the shared entry point behind both TraceChain, which buffers
+// every event into one synchronous JSON-RPC response capped at
+// maxTraceChainBlocks, and ServeTraceChainNDJSON, which streams events to
+// an HTTP client as they're produced and isn't subject to that cap.
+func (d *DebugEndpoints) runTraceChainPipeline(ctx context.Context, start, end uint64, cfg *traceConfig, emit func(traceChainEvent)) types.Error {
+	pipelineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// the size of the buffer defines
-	// how many txs it will process in parallel.
-	const bufferSize = 10
+	workerCount := boundedWorkerCount(d.chainTraceWorkers, 0)
 
-	// builds the url of the jRPC server from the data found in the httpRequest
-	scheme := "https"
-	if httpRequest.URL.Scheme != "" {
-		scheme = httpRequest.URL.Scheme
+	jobs := make(chan traceChainJob, defaultTraceChainJobBuffer)
+	results := make(chan traceChainJobResult, defaultTraceChainJobBuffer)
+	blockSizes := make(chan traceChainBlockSize, defaultTraceChainJobBuffer)
+
+	// one goroutine fetches blocks sequentially and feeds their
+	// transactions to the worker pool, reporting how many transactions
+	// each block has so the reassembler knows when a block is complete.
+	go d.produceTraceChainJobs(pipelineCtx, start, end, jobs, blockSizes)
+
+	// N workers trace transactions from the bounded jobs channel, each
+	// with its own dbTx so they don't serialize on one Postgres
+	// transaction.
+	var workers sync.WaitGroup
+	workers.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
+		go func() {
+			defer workers.Done()
+			d.traceChainWorker(pipelineCtx, jobs, results, cfg)
+		}()
 	}
-	u := url.URL{
-		Scheme: scheme,
-		Host:   httpRequest.Host,
-		Path:   httpRequest.URL.Path,
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	// the reassembler emits events in block/tx order using a small
+	// reorder buffer keyed by (blockNumber, txIndex), since workers can
+	// finish out of order. cancel() (deferred above) stops the producer
+	// and every worker as soon as reassembleTraceChainResults returns, on
+	// the error path as much as the success path.
+	return d.reassembleTraceChainResults(pipelineCtx, start, results, blockSizes, emit)
+}
+
+// ServeTraceChainNDJSON streams the same trace events TraceChain produces,
+// but as newline-delimited JSON flushed to the client as soon as each event
+// is ready, instead of one synchronous JSON-RPC array. It isn't subject to
+// maxTraceChainBlocks, since the response is never held in memory as a
+// whole: a huge range is fine as long as the client keeps reading.
+//
+// This is a plain net/http handler rather than a jsonrpc method because the
+// JSON-RPC server this package's methods are registered against has no
+// chunked-transfer hook for RPC methods — every method's return value is
+// serialized as one synchronous response. Whatever mounts this package's
+// handlers needs to route e.g. GET /debug/traceChain to this method
+// alongside the regular JSON-RPC endpoint.
+//
+// Query parameters: start and end (required, accepting the same formats as
+// the start/end parameters of debug_traceChain, e.g. "0x10" or "latest"),
+// and tracer/tracerConfig/disableStack/disableStorage/enableMemory/
+// enableReturnData/timeout/reexec (optional, same meaning as the fields of
+// traceConfig).
+func (d *DebugEndpoints) ServeTraceChainNDJSON(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	startNumber, endNumber, cfg, err := parseTraceChainNDJSONParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	rpcURL := u.String()
 
+	ctx := r.Context()
+	streaming := false
+	_, rpcErr := d.txMan.NewDbTxScope(d.state, func(dbTxCtx context.Context, dbTx pgx.Tx) (interface{}, types.Error) {
+		start, rpcErr := startNumber.GetNumericBlockNumber(dbTxCtx, d.state, dbTx)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		end, rpcErr := endNumber.GetNumericBlockNumber(dbTxCtx, d.state, dbTx)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		if end < start {
+			return nil, types.NewRPCError(types.DefaultErrorCode, fmt.Sprintf("end block #%d is before start block #%d", end, start))
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		streaming = true
+
+		enc := json.NewEncoder(w)
+		return nil, d.runTraceChainPipeline(ctx, start, end, cfg, func(event traceChainEvent) {
+			// once headers are sent, an encode error just means the
+			// client went away; runTraceChainPipeline's ctx isn't ours to
+			// cancel from inside this callback, so the failed event is
+			// logged and dropped, and each later event is still attempted
+			// until the pipeline ends or r.Context() is cancelled.
+			if encErr := enc.Encode(event); encErr != nil {
+				log.Errorf("failed to stream trace chain event: %v", encErr)
+				return
+			}
+			flusher.Flush()
+		})
+	})
+	if rpcErr != nil {
+		// once runTraceChainPipeline has started, headers are already
+		// committed to the 200 response above, so an error from it (e.g.
+		// a failed trace) can only be logged and ends the stream.
+		if streaming {
+			log.Errorf("trace chain stream ended early: %v", rpcErr.Error())
+			return
+		}
+		// before that (range validation, resolving start/end) nothing has
+		// been written yet, so the error becomes the response.
+		http.Error(w, rpcErr.Error(), http.StatusBadRequest)
+	}
+}
+
+// parseTraceChainNDJSONParams reads the start/end block numbers and trace
+// config out of r's query string for ServeTraceChainNDJSON, the same way
+// the jsonrpc dispatcher decodes them from a debug_traceChain request's
+// JSON params.
+func parseTraceChainNDJSONParams(r *http.Request) (types.BlockNumber, types.BlockNumber, *traceConfig, error) {
+	query := r.URL.Query()
+
+	start, err := parseBlockNumberParam(query.Get("start"))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := parseBlockNumberParam(query.Get("end"))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid end: %w", err)
+	}
+
+	cfg := &traceConfig{
+		DisableStack:     query.Get("disableStack") == "true",
+		DisableStorage:   query.Get("disableStorage") == "true",
+		EnableMemory:     query.Get("enableMemory") == "true",
+		EnableReturnData: query.Get("enableReturnData") == "true",
+	}
+	if tracer := query.Get("tracer"); tracer != "" {
+		cfg.Tracer = &tracer
+	}
+	if tracerConfig := query.Get("tracerConfig"); tracerConfig != "" {
+		cfg.TracerConfig = json.RawMessage(tracerConfig)
+	}
+	if timeout := query.Get("timeout"); timeout != "" {
+		cfg.Timeout = &timeout
+	}
+	if reexec := query.Get("reexec"); reexec != "" {
+		value, err := strconv.ParseUint(reexec, 0, 64)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid reexec: %w", err)
+		}
+		cfg.Reexec = &value
+	}
+
+	return start, end, cfg, nil
+}
+
+// parseBlockNumberParam decodes a single block number query parameter using
+// types.BlockNumber's own JSON decoding, so it accepts the same formats
+// (hex numbers, "latest", "earliest", "pending") as a debug_traceChain
+// JSON-RPC request.
+func parseBlockNumberParam(raw string) (types.BlockNumber, error) {
+	if raw == "" {
+		return 0, errors.New("missing required parameter")
+	}
+
+	var blockNumber types.BlockNumber
+	if err := json.Unmarshal([]byte(strconv.Quote(raw)), &blockNumber); err != nil {
+		return 0, err
+	}
+	return blockNumber, nil
+}
+
+// traceChainBlockSize reports how many transactions a given block in the
+// range has, so the reassembler knows when it has seen every result for
+// that block and can advance to the next one.
+type traceChainBlockSize struct {
+	blockNumber uint64
+	txCount     int
+}
+
+// produceTraceChainJobs walks [start, end] sequentially, pushing one job
+// per transaction onto jobs and one size onto blockSizes per block. It
+// stops as soon as ctx is cancelled.
+func (d *DebugEndpoints) produceTraceChainJobs(ctx context.Context, start, end uint64, jobs chan<- traceChainJob, blockSizes chan<- traceChainBlockSize) {
+	defer close(jobs)
+	defer close(blockSizes)
+
+	for blockNumber := start; blockNumber <= end; blockNumber++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		block, err := d.state.GetL2BlockByNumber(ctx, blockNumber, nil)
+		if errors.Is(err, state.ErrNotFound) {
+			block = nil
+		} else if err != nil {
+			log.Errorf("failed to get block #%d while tracing chain: %v", blockNumber, err)
+			return
+		}
+
+		txCount := 0
+		if block != nil {
+			txCount = len(block.Transactions())
+			for txIndex, tx := range block.Transactions() {
+				select {
+				case jobs <- traceChainJob{blockNumber: blockNumber, txIndex: txIndex, tx: tx}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		select {
+		case blockSizes <- traceChainBlockSize{blockNumber: blockNumber, txCount: txCount}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// traceChainWorker traces jobs until the jobs channel is closed or ctx is
+// cancelled, acquiring its own dbTx so it never blocks on another worker.
+func (d *DebugEndpoints) traceChainWorker(ctx context.Context, jobs <-chan traceChainJob, results chan<- traceChainJobResult, cfg *traceConfig) {
+	for {
+		select {
+		case job, ok := <-jobs:
+			if !ok {
+				return
+			}
+
+			dbTx, err := d.state.BeginStateTransaction(ctx)
+			if err != nil {
+				select {
+				case results <- traceChainJobResult{
+					blockNumber: job.blockNumber,
+					txIndex:     job.txIndex,
+					txHash:      job.tx.Hash(),
+					err:         types.NewRPCError(types.DefaultErrorCode, fmt.Sprintf("failed to begin state transaction: %v", err)),
+				}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			traceResult, rpcErr := d.buildTraceTransaction(ctx, job.tx.Hash(), cfg, dbTx)
+			if err := dbTx.Rollback(ctx); err != nil {
+				log.Errorf("failed to rollback dbTx while tracing chain: %v", err)
+			}
+
+			select {
+			case results <- traceChainJobResult{
+				blockNumber: job.blockNumber,
+				txIndex:     job.txIndex,
+				txHash:      job.tx.Hash(),
+				result:      traceResult,
+				err:         rpcErr,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reassembleTraceChainResults keeps only the results that arrive ahead of
+// the next expected (blockNumber, txIndex) in a small reorder buffer, and
+// calls emit in chain order as soon as that gap closes, rather than
+// waiting for the whole range to complete. emit is called synchronously
+// from this goroutine, so a caller that wants to stream the response (e.g.
+// over NDJSON) can write and flush directly from it instead of buffering;
+// TraceChain currently still appends into a slice because its response is
+// one synchronous JSON-RPC result, but reassembleTraceChainResults itself
+// holds no more than the in-flight reorder buffer at any point.
+//
+// ctx is only consulted to detect cancellation; it is the caller's
+// responsibility (see runTraceChainPipeline) to also cancel the producer/worker
+// pipeline feeding results and blockSizes once this function returns, on
+// the error path as much as the success path.
+func (d *DebugEndpoints) reassembleTraceChainResults(ctx context.Context, start uint64, results <-chan traceChainJobResult, blockSizes <-chan traceChainBlockSize, emit func(traceChainEvent)) types.Error {
+	type key struct {
+		blockNumber uint64
+		txIndex     int
+	}
+
+	pendingResults := make(map[key]traceChainJobResult)
+	blockTxCount := make(map[uint64]int)
+
+	nextBlock := start
+	nextTxIndex := 0
+
+	// advance emits every already-seen result starting at
+	// (nextBlock, nextTxIndex), stopping at the first gap or the first
+	// block whose size isn't known yet.
+	advance := func() types.Error {
+		for {
+			count, sizeKnown := blockTxCount[nextBlock]
+			if !sizeKnown {
+				return nil
+			}
+
+			if nextTxIndex >= count {
+				delete(blockTxCount, nextBlock)
+				nextBlock++
+				nextTxIndex = 0
+				continue
+			}
+
+			k := key{blockNumber: nextBlock, txIndex: nextTxIndex}
+			r, ok := pendingResults[k]
+			if !ok {
+				return nil
+			}
+			delete(pendingResults, k)
+
+			if r.err != nil {
+				return r.err
+			}
+			emit(traceChainEvent{
+				BlockNumber: types.ArgUint64(r.blockNumber),
+				TxHash:      r.txHash,
+				Result:      r.result,
+			})
+			nextTxIndex++
+		}
+	}
+
+	for blockSizes != nil || results != nil {
+		select {
+		case size, ok := <-blockSizes:
+			if !ok {
+				blockSizes = nil
+				continue
+			}
+			blockTxCount[size.blockNumber] = size.txCount
+			if rpcErr := advance(); rpcErr != nil {
+				return rpcErr
+			}
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			pendingResults[key{blockNumber: r.blockNumber, txIndex: r.txIndex}] = r
+			if rpcErr := advance(); rpcErr != nil {
+				return rpcErr
+			}
+		case <-ctx.Done():
+			return types.NewRPCError(types.DefaultErrorCode, "trace chain request cancelled")
+		}
+	}
+
+	return nil
+}
+
+// TraceBatchByNumber creates a response for debug_traceBatchByNumber request.
+// this endpoint tries to help clients to get traces at once for all the
+// transactions attached to the same batch.
+//
+// By default every transaction in the batch is traced in-process by a
+// bounded pool of batchTraceWorkers goroutines (runtime.NumCPU() workers
+// when unset), each with its own dbTx so they don't serialize on a single
+// Postgres transaction. Results are written into a slice indexed by the
+// tx's position in the batch so the response order always matches the
+// batch, and a failed trace is reported back as a per-tx error instead of
+// being silently dropped.
+//
+// Setting traceBatchSelfFanout recovers the legacy behavior, where the
+// picked jRPC instance redirects each trace transaction request back
+// through the balancer so the load is spread across every jRPC/Executor
+// instance instead of the one instance that got picked for the batch
+// request:
+// -> user does a trace batch request
+// -> jRPC balancer picks a jRPC server to handle the trace batch request
+// -> picked jRPC sends parallel trace transaction requests for each transaction in the batch
+// -> jRPC balancer sends each request to a different jRPC to handle the trace transaction requests
+// -> picked jRPC server groups the trace transaction responses from other jRPC servers
+// -> picked jRPC responds to the initial request with all the tx traces
+func (d *DebugEndpoints) TraceBatchByNumber(httpRequest *http.Request, number types.BatchNumber, cfg *traceConfig) (interface{}, types.Error) {
 	return d.txMan.NewDbTxScope(d.state, func(ctx context.Context, dbTx pgx.Tx) (interface{}, types.Error) {
 		batchNumber, rpcErr := number.GetNumericBatchNumber(ctx, d.state, dbTx)
 		if rpcErr != nil {
@@ -194,64 +797,155 @@ func (d *DebugEndpoints) TraceBatchByNumber(httpRequest *http.Request, number ty
 			receipts = append(receipts, *receipt)
 		}
 
-		requests := make(chan (ethTypes.Receipt), bufferSize)
+		if d.traceBatchSelfFanout {
+			return d.traceBatchOverHTTP(httpRequest, batchNumber, receipts, cfg)
+		}
 
-		wg := sync.WaitGroup{}
-		wg.Add(len(receipts))
-		responses := make(chan (traceBatchTransactionResponse), len(receipts))
+		return d.traceBatchInProcess(ctx, receipts, cfg), nil
+	})
+}
 
-		// gets the trace from the jRPC and adds it to the responses
-		loadTraceByTxHash := func(receipt ethTypes.Receipt) {
-			defer wg.Done()
-			res, err := client.JSONRPCCall(rpcURL, "debug_traceTransaction", receipt.TxHash.String(), cfg)
-			if err != nil {
-				log.Errorf("failed to get tx trace from remote jRPC server %v, err: %v", rpcURL, err)
-				return
-			}
+// traceBatchJob is one unit of work for the TraceBatchByNumber worker pool:
+// a receipt plus its position in the batch, so results can be written back
+// in the same order the batch has.
+type traceBatchJob struct {
+	index   int
+	receipt ethTypes.Receipt
+}
 
-			if res.Error != nil {
-				log.Errorf("tx trace error returned from remote jRPC server %v, %v %v", rpcURL, res.Error.Code, res.Error.Message)
-				return
-			}
+// traceBatchInProcess traces every receipt with a bounded pool of workers,
+// each owning its own dbTx, and returns one traceBatchTransactionResponse
+// per receipt in the same order they were given.
+func (d *DebugEndpoints) traceBatchInProcess(ctx context.Context, receipts []ethTypes.Receipt, cfg *traceConfig) []traceBatchTransactionResponse {
+	traces := make([]traceBatchTransactionResponse, len(receipts))
+	if len(receipts) == 0 {
+		return traces
+	}
 
-			// add to the responses
-			responses <- traceBatchTransactionResponse{
-				TxHash: receipt.TxHash,
-				Result: res.Result,
-			}
-		}
+	workerCount := boundedWorkerCount(d.batchTraceWorkers, len(receipts))
 
-		// goes through the buffer and loads the trace
-		// by all the transactions added in the buffer
-		// then add the results to the responses map
+	jobs := make(chan traceBatchJob, len(receipts))
+	for i, receipt := range receipts {
+		jobs <- traceBatchJob{index: i, receipt: receipt}
+	}
+	close(jobs)
+
+	var workers sync.WaitGroup
+	workers.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
 		go func() {
-			index := uint(0)
-			for req := range requests {
-				go loadTraceByTxHash(req)
-				index++
+			defer workers.Done()
+			for job := range jobs {
+				traces[job.index] = d.traceBatchTx(ctx, job.receipt, cfg)
 			}
 		}()
+	}
+	workers.Wait()
 
-		// add receipts to the buffer
-		for _, receipt := range receipts {
-			requests <- receipt
-		}
+	return traces
+}
 
-		// wait the traces to be loaded
-		if waitTimeout(&wg, timeout) {
-			return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("failed to get traces for batch %v: timeout reached", batchNumber), nil)
+// traceBatchTx traces a single receipt with its own dbTx, so it never
+// blocks on another worker's Postgres transaction, and turns a failure
+// into a per-tx error instead of dropping the tx from the response.
+func (d *DebugEndpoints) traceBatchTx(ctx context.Context, receipt ethTypes.Receipt, cfg *traceConfig) traceBatchTransactionResponse {
+	dbTx, err := d.state.BeginStateTransaction(ctx)
+	if err != nil {
+		return traceBatchTransactionResponse{TxHash: receipt.TxHash, Error: fmt.Sprintf("failed to begin state transaction: %v", err)}
+	}
+	defer func() {
+		if err := dbTx.Rollback(ctx); err != nil {
+			log.Errorf("failed to rollback dbTx while tracing batch tx %v: %v", receipt.TxHash.String(), err)
 		}
+	}()
 
-		close(requests)
-		close(responses)
+	result, rpcErr := d.buildTraceTransaction(ctx, receipt.TxHash, cfg, dbTx)
+	if rpcErr != nil {
+		return traceBatchTransactionResponse{TxHash: receipt.TxHash, Error: rpcErr.Error()}
+	}
 
-		// build the batch trace response array
-		traces := make([]traceBatchTransactionResponse, 0, len(receipts))
-		for response := range responses {
-			traces = append(traces, response)
-		}
+	return traceBatchTransactionResponse{TxHash: receipt.TxHash, Result: result}
+}
+
+// traceBatchOverHTTP recovers the legacy self-fan-out behavior: each
+// receipt is traced by redirecting a debug_traceTransaction request back
+// through the balancer at rpcURL, built from the original httpRequest, so
+// the load is spread across every jRPC/Executor instance in the pool.
+func (d *DebugEndpoints) traceBatchOverHTTP(httpRequest *http.Request, batchNumber uint64, receipts []ethTypes.Receipt, cfg *traceConfig) (interface{}, types.Error) {
+	// timeout is the maximum time the code will wait for all the
+	// traces to be loaded from the jRPC and added to the responses.
+	const timeout = 10 * time.Minute
+
+	// workerCount bounds how many trace requests are in flight against
+	// the balancer at once.
+	const workerCount = 10
+
+	scheme := "https"
+	if httpRequest.URL.Scheme != "" {
+		scheme = httpRequest.URL.Scheme
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   httpRequest.Host,
+		Path:   httpRequest.URL.Path,
+	}
+	rpcURL := u.String()
+
+	traces := make([]traceBatchTransactionResponse, len(receipts))
+	if len(receipts) == 0 {
 		return traces, nil
-	})
+	}
+
+	jobs := make(chan traceBatchJob, len(receipts))
+	for i, receipt := range receipts {
+		jobs <- traceBatchJob{index: i, receipt: receipt}
+	}
+	close(jobs)
+
+	n := workerCount
+	if n > len(receipts) {
+		n = len(receipts)
+	}
+
+	var workers sync.WaitGroup
+	workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				traces[job.index] = loadTraceByTxHashOverHTTP(rpcURL, job.receipt, cfg)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return traces, nil
+	case <-time.After(timeout):
+		return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("failed to get traces for batch %v: timeout reached", batchNumber), nil)
+	}
+}
+
+// loadTraceByTxHashOverHTTP proxies a single debug_traceTransaction request
+// to rpcURL, returning a per-tx error instead of dropping the tx silently
+// on failure.
+func loadTraceByTxHashOverHTTP(rpcURL string, receipt ethTypes.Receipt, cfg *traceConfig) traceBatchTransactionResponse {
+	res, err := client.JSONRPCCall(rpcURL, "debug_traceTransaction", receipt.TxHash.String(), cfg)
+	if err != nil {
+		return traceBatchTransactionResponse{TxHash: receipt.TxHash, Error: fmt.Sprintf("failed to get tx trace from remote jRPC server %v: %v", rpcURL, err)}
+	}
+
+	if res.Error != nil {
+		return traceBatchTransactionResponse{TxHash: receipt.TxHash, Error: fmt.Sprintf("tx trace error returned from remote jRPC server %v: %v %v", rpcURL, res.Error.Code, res.Error.Message)}
+	}
+
+	return traceBatchTransactionResponse{TxHash: receipt.TxHash, Result: res.Result}
 }
 
 func (d *DebugEndpoints) buildTraceBlock(ctx context.Context, txs []*ethTypes.Transaction, cfg *traceConfig, dbTx pgx.Tx) (interface{}, types.Error) {
@@ -272,16 +966,38 @@ func (d *DebugEndpoints) buildTraceBlock(ctx context.Context, txs []*ethTypes.Tr
 }
 
 func (d *DebugEndpoints) buildTraceTransaction(ctx context.Context, hash common.Hash, cfg *traceConfig, dbTx pgx.Tx) (interface{}, types.Error) {
+	const fallbackMethod = "debug_traceTransaction"
+
 	traceCfg := cfg
 	if traceCfg == nil {
 		traceCfg = defaultTraceConfig
 	}
 
 	// check tracer
-	if traceCfg.Tracer != nil && *traceCfg.Tracer != "" && !isBuiltInTracer(*traceCfg.Tracer) && !isJSCustomTracer(*traceCfg.Tracer) {
-		return rpcErrorResponse(types.DefaultErrorCode, "invalid tracer", nil)
+	if traceCfg.Tracer != nil && *traceCfg.Tracer != "" && !isBuiltInTracer(*traceCfg.Tracer) {
+		if _, err := parseJSCustomTracer(*traceCfg.Tracer); err != nil {
+			return rpcErrorResponse(types.DefaultErrorCode, "invalid tracer", err)
+		}
+	}
+
+	// some operators pin specific methods/tracers to the fallback
+	// regardless of whether this node could serve them locally.
+	if d.fallbackClient.isPinned(fallbackMethod, traceCfg.Tracer) {
+		return d.dispatchToFallback(fallbackMethod, hash.String(), cfg)
 	}
 
+	tracedCtx, cancel, appliedTimeout, rpcErr := withTraceTimeout(ctx, traceCfg)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	defer cancel()
+
+	// NOTE: state.TraceConfig doesn't have Reexec/JSHooks/Stop fields yet
+	// (see endpoints_debug_tracecall.go), so the parsed tracer hooks and
+	// cooperative-stop signal can't be threaded through here without
+	// breaking every debug_trace* endpoint that shares this helper. This
+	// stays on the original field set until the companion state-layer
+	// change lands.
 	stateTraceConfig := state.TraceConfig{
 		DisableStack:     traceCfg.DisableStack,
 		DisableStorage:   traceCfg.DisableStorage,
@@ -290,8 +1006,15 @@ func (d *DebugEndpoints) buildTraceTransaction(ctx context.Context, hash common.
 		Tracer:           traceCfg.Tracer,
 		TracerConfig:     traceCfg.TracerConfig,
 	}
-	result, err := d.state.DebugTransaction(ctx, hash, stateTraceConfig, dbTx)
-	if errors.Is(err, state.ErrNotFound) {
+	result, err := d.state.DebugTransaction(tracedCtx, hash, stateTraceConfig, dbTx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rpcErrorResponse(types.DefaultErrorCode, traceTimeoutErrorMessage(appliedTimeout), nil)
+	} else if errors.Is(err, state.ErrNotFound) {
+		// the block/tx may be older than this node's pruned state: hand
+		// the original request to the upstream archive/tracing node.
+		if d.fallbackClient.allowsMethod(fallbackMethod) {
+			return d.dispatchToFallback(fallbackMethod, hash.String(), cfg)
+		}
 		return rpcErrorResponse(types.DefaultErrorCode, "transaction not found", nil)
 	} else if err != nil {
 		const errorMessage = "failed to get trace"
@@ -422,25 +1145,179 @@ func isBuiltInTracer(tracer string) bool {
 	}
 }
 
-// isJSCustomTracer checks if the tracer contains the
-// functions result and fault which are required for a custom tracer
+// dispatchToFallback proxies method to the configured fallback client and
+// returns its raw result, unwrapped from the JSON-RPC envelope.
+func (d *DebugEndpoints) dispatchToFallback(method string, params ...interface{}) (interface{}, types.Error) {
+	res, err := client.JSONRPCCall(d.fallbackClient.URL, method, params...)
+	if err != nil {
+		return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("failed to proxy %v to fallback node", method), err)
+	}
+	if res.Error != nil {
+		return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("fallback node returned error for %v", method), errors.New(res.Error.Message))
+	}
+	return res.Result, nil
+}
+
+// jsTracerHooks are the object-literal properties a JS custom tracer may
+// define. result and fault are mandatory; the rest mirror the optional
+// hook surface introduced in go-ethereum's tracer refactor.
 // https://geth.ethereum.org/docs/developers/evm-tracing/custom-tracer
+var jsTracerHooks = map[string]bool{
+	"result": true,
+	"fault":  true,
+	"step":   true,
+	"enter":  true,
+	"exit":   true,
+	"setup":  true,
+}
+
+// isJSCustomTracer reports whether tracer is a valid JS custom tracer.
 func isJSCustomTracer(tracer string) bool {
-	return strings.Contains(tracer, "result") && strings.Contains(tracer, "fault")
+	_, err := parseJSCustomTracer(tracer)
+	return err == nil
 }
 
-// waitTimeout waits for the waitGroup for the specified max timeout.
-// Returns true if waiting timed out.
-func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		wg.Wait()
-	}()
-	select {
-	case <-c:
-		return false // completed normally
-	case <-time.After(timeout):
-		return true // timed out
+// parseJSCustomTracer tokenizes tracer and verifies it evaluates to a
+// top-level object literal whose "result" and "fault" properties are
+// function expressions, optionally alongside "step", "enter", "exit" and
+// "setup". Unlike a plain substring check, it ignores these words when
+// they show up inside a comment or a string literal, and rejects object
+// literals that merely mention them via a computed property name instead
+// of actually defining them as functions. It returns the set of hooks the
+// tracer defines, so the state layer only wires up the ones present.
+func parseJSCustomTracer(tracer string) (map[string]bool, error) {
+	tokens, err := tokenizeJS(tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracer: %w", err)
+	}
+
+	hooks := make(map[string]bool)
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i].kind {
+		case jsTokenLBrace:
+			depth++
+		case jsTokenRBrace:
+			depth--
+		case jsTokenIdent:
+			// only hook properties declared at the top level of the
+			// outermost object literal count; a "result" identifier
+			// nested inside a function body is not a hook definition.
+			if depth != 1 || !jsTracerHooks[tokens[i].value] {
+				continue
+			}
+			if i+1 < len(tokens) && tokens[i+1].kind == jsTokenColon && isJSFunctionExpr(tokens, i+2) {
+				hooks[tokens[i].value] = true
+			}
+		}
+	}
+
+	if !hooks["result"] || !hooks["fault"] {
+		return nil, errors.New(`tracer must be an object literal defining function-valued "result" and "fault" properties`)
 	}
+
+	return hooks, nil
+}
+
+// isJSFunctionExpr reports whether tokens starting at idx begin a function
+// expression. Every hook in geth's custom tracer examples is declared with
+// the "function" keyword, so that's what's required here; arrow functions
+// are intentionally not recognized since doing so correctly would require
+// tracking parentheses, which this lexer does not do.
+func isJSFunctionExpr(tokens []jsToken, idx int) bool {
+	return idx < len(tokens) && tokens[idx].kind == jsTokenIdent && tokens[idx].value == "function"
+}
+
+// jsTokenKind enumerates the handful of token kinds parseJSCustomTracer
+// needs to tell apart; everything else is lexed but reported as jsTokenOther.
+type jsTokenKind int
+
+const (
+	jsTokenOther jsTokenKind = iota
+	jsTokenIdent
+	jsTokenLBrace
+	jsTokenRBrace
+	jsTokenColon
+)
+
+type jsToken struct {
+	kind  jsTokenKind
+	value string
+}
+
+// tokenizeJS is a minimal JS lexer, good enough to validate a custom
+// tracer's shape: it understands line/block comments and single-,
+// double- and backtick-quoted strings (including escapes) so that braces,
+// colons or hook names appearing inside them aren't mistaken for actual
+// syntax. It does not build a full AST.
+func tokenizeJS(src string) ([]jsToken, error) {
+	var tokens []jsToken
+	r := []rune(src)
+	n := len(r)
+
+	for i := 0; i < n; {
+		c := r[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '/' && i+1 < n && r[i+1] == '/':
+			for i < n && r[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < n && r[i+1] == '*':
+			i += 2
+			closed := false
+			for i+1 < n {
+				if r[i] == '*' && r[i+1] == '/' {
+					i += 2
+					closed = true
+					break
+				}
+				i++
+			}
+			if !closed {
+				return nil, errors.New("unterminated block comment")
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote := c
+			i++
+			for i < n && r[i] != quote {
+				if r[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= n {
+				return nil, errors.New("unterminated string literal")
+			}
+			i++
+		case c == '{':
+			tokens = append(tokens, jsToken{kind: jsTokenLBrace})
+			i++
+		case c == '}':
+			tokens = append(tokens, jsToken{kind: jsTokenRBrace})
+			i++
+		case c == ':':
+			tokens = append(tokens, jsToken{kind: jsTokenColon})
+			i++
+		case isJSIdentStart(c):
+			start := i
+			for i < n && isJSIdentPart(r[i]) {
+				i++
+			}
+			tokens = append(tokens, jsToken{kind: jsTokenIdent, value: string(r[start:i])})
+		default:
+			i++
+		}
+	}
+
+	return tokens, nil
+}
+
+func isJSIdentStart(c rune) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isJSIdentPart(c rune) bool {
+	return isJSIdentStart(c) || (c >= '0' && c <= '9')
 }
@@ -0,0 +1,77 @@
+package jsonrpc
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestBoundedWorkerCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured int
+		maxTasks   int
+		want       int
+	}{
+		{name: "configured value is used as-is when within maxTasks", configured: 4, maxTasks: 10, want: 4},
+		{name: "configured value is clamped down to maxTasks", configured: 8, maxTasks: 3, want: 3},
+		{name: "zero maxTasks leaves the result unclamped", configured: 8, maxTasks: 0, want: 8},
+		{name: "non-positive configured falls back to NumCPU", configured: 0, maxTasks: 0, want: runtime.NumCPU()},
+		{name: "NumCPU fallback is still clamped to maxTasks", configured: -1, maxTasks: 1, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := boundedWorkerCount(tt.configured, tt.maxTasks); got != tt.want {
+				t.Errorf("boundedWorkerCount(%d, %d) = %d, want %d", tt.configured, tt.maxTasks, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebugFallbackConfigAllowsMethod(t *testing.T) {
+	var nilConfig *debugFallbackConfig
+	if nilConfig.allowsMethod("debug_traceTransaction") {
+		t.Error("a nil config must not allow any method")
+	}
+
+	cfg := &debugFallbackConfig{AllowedMethods: []string{"debug_traceTransaction"}}
+	if !cfg.allowsMethod("debug_traceTransaction") {
+		t.Error("expected debug_traceTransaction to be allowed")
+	}
+	if cfg.allowsMethod("debug_traceCall") {
+		t.Error("debug_traceCall was never added to AllowedMethods")
+	}
+}
+
+func TestDebugFallbackConfigIsPinned(t *testing.T) {
+	prestate := "prestateTracer"
+	callTracer := "callTracer"
+
+	var nilConfig *debugFallbackConfig
+	if nilConfig.isPinned("debug_traceCall", &prestate) {
+		t.Error("a nil config must not pin anything")
+	}
+
+	cfg := &debugFallbackConfig{
+		PinnedTracers: map[string][]string{
+			"debug_traceCall":        {prestate},
+			"debug_traceTransaction": {},
+		},
+	}
+
+	if !cfg.isPinned("debug_traceCall", &prestate) {
+		t.Error("expected debug_traceCall with prestateTracer to be pinned")
+	}
+	if cfg.isPinned("debug_traceCall", &callTracer) {
+		t.Error("debug_traceCall with callTracer is not in the pinned tracer list")
+	}
+	if cfg.isPinned("debug_traceCall", nil) {
+		t.Error("a nil tracer doesn't match any pinned tracer name")
+	}
+	if !cfg.isPinned("debug_traceTransaction", nil) {
+		t.Error("an empty tracer list pins every request for that method")
+	}
+	if cfg.isPinned("debug_traceCallMany", &prestate) {
+		t.Error("debug_traceCallMany was never configured as pinned")
+	}
+}
@@ -0,0 +1,205 @@
+//go:build zkevm_debug_tracecall
+
+package jsonrpc
+
+// TraceCall (debug_traceCall) depends on state-layer symbols that don't
+// exist in the state package yet: state.DebugTraceCall, state.OverrideAccount,
+// state.BlockOverrides, state.ErrUnsupportedTracer, and Reexec/JSHooks/Stop on
+// state.TraceConfig. Gating this file behind the zkevm_debug_tracecall build
+// tag keeps the rest of the jsonrpc package compiling without those symbols;
+// build with the tag once the companion state-layer change lands.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/0xPolygonHermez/zkevm-node/jsonrpc/types"
+	"github.com/0xPolygonHermez/zkevm-node/log"
+	"github.com/0xPolygonHermez/zkevm-node/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jackc/pgx/v4"
+)
+
+type traceCallConfig struct {
+	traceConfig
+	StateOverrides *map[common.Address]stateOverride `json:"stateOverrides"`
+	BlockOverrides *blockOverrides                   `json:"blockOverrides"`
+}
+
+// stateOverride customizes the state of a single account before a
+// debug_traceCall simulation runs, mirroring the override set accepted
+// by eth_call.
+type stateOverride struct {
+	Nonce     *types.ArgUint64             `json:"nonce"`
+	Code      *types.ArgBytes              `json:"code"`
+	Balance   *types.ArgBig                `json:"balance"`
+	State     *map[common.Hash]common.Hash `json:"state"`
+	StateDiff *map[common.Hash]common.Hash `json:"stateDiff"`
+}
+
+// blockOverrides customizes the block context a debug_traceCall
+// simulation is executed against, letting callers pin a future number,
+// timestamp, coinbase or base fee without that block existing yet.
+type blockOverrides struct {
+	Number     *types.ArgUint64 `json:"number"`
+	Time       *types.ArgUint64 `json:"time"`
+	Difficulty *types.ArgBig    `json:"difficulty"`
+	GasLimit   *types.ArgUint64 `json:"gasLimit"`
+	Coinbase   *common.Address  `json:"coinbase"`
+	Random     *common.Hash     `json:"random"`
+	BaseFee    *types.ArgBig    `json:"baseFee"`
+}
+
+// TraceCall creates a response for debug_traceCall request. It behaves like
+// eth_call in that it executes a message that is not part of any mined
+// block, but returns a tracer/struct-log result the same way the other
+// debug_trace* endpoints do.
+// See https://geth.ethereum.org/docs/interacting-with-geth/rpc/ns-debug#debugtracecall
+func (d *DebugEndpoints) TraceCall(args types.TxArgs, blockNrOrHash types.BlockNumberOrHash, cfg *traceCallConfig) (interface{}, types.Error) {
+	return d.txMan.NewDbTxScope(d.state, func(ctx context.Context, dbTx pgx.Tx) (interface{}, types.Error) {
+		blockNumber, rpcErr := blockNrOrHash.GetNumericBlockNumber(ctx, d.state, dbTx)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+
+		return d.buildTraceCall(ctx, args, blockNrOrHash, blockNumber, cfg, dbTx)
+	})
+}
+
+// buildTraceCall applies the state and block overrides (if any) on top of
+// the state at blockNumber, builds the unsigned message described by args
+// and traces its execution the same way buildTraceTransaction does for a
+// mined transaction. blockNrOrHash is kept around only to pass through to
+// the fallback client verbatim, the same way the caller originally
+// specified it.
+func (d *DebugEndpoints) buildTraceCall(ctx context.Context, args types.TxArgs, blockNrOrHash types.BlockNumberOrHash, blockNumber uint64, cfg *traceCallConfig, dbTx pgx.Tx) (interface{}, types.Error) {
+	const fallbackMethod = "debug_traceCall"
+
+	var traceCfg *traceConfig
+	if cfg != nil {
+		traceCfg = &cfg.traceConfig
+	}
+	if traceCfg == nil {
+		traceCfg = defaultTraceConfig
+	}
+
+	var jsHooks map[string]bool
+	if traceCfg.Tracer != nil && *traceCfg.Tracer != "" && !isBuiltInTracer(*traceCfg.Tracer) {
+		hooks, err := parseJSCustomTracer(*traceCfg.Tracer)
+		if err != nil {
+			return rpcErrorResponse(types.DefaultErrorCode, "invalid tracer", err)
+		}
+		jsHooks = hooks
+	}
+
+	// some operators pin specific methods/tracers to the fallback
+	// regardless of whether this node could serve them locally.
+	if d.fallbackClient.isPinned(fallbackMethod, traceCfg.Tracer) {
+		return d.dispatchToFallback(fallbackMethod, args, blockNrOrHash, cfg)
+	}
+
+	var stateOverrides map[common.Address]state.OverrideAccount
+	if cfg != nil && cfg.StateOverrides != nil {
+		stateOverrides = make(map[common.Address]state.OverrideAccount, len(*cfg.StateOverrides))
+		for addr, override := range *cfg.StateOverrides {
+			stateOverrides[addr] = state.OverrideAccount{
+				Nonce:     override.Nonce,
+				Code:      override.Code,
+				Balance:   override.Balance,
+				State:     override.State,
+				StateDiff: override.StateDiff,
+			}
+		}
+	}
+
+	var blockOverride *state.BlockOverrides
+	if cfg != nil && cfg.BlockOverrides != nil {
+		bo := cfg.BlockOverrides
+		blockOverride = &state.BlockOverrides{
+			Number:     bo.Number,
+			Time:       bo.Time,
+			Difficulty: bo.Difficulty,
+			GasLimit:   bo.GasLimit,
+			Coinbase:   bo.Coinbase,
+			Random:     bo.Random,
+			BaseFee:    bo.BaseFee,
+		}
+	}
+
+	sender, tx, err := args.ToTransaction(ctx, d.state, blockNumber, dbTx)
+	if err != nil {
+		return rpcErrorResponse(types.DefaultErrorCode, "failed to build tx from params", err)
+	}
+
+	tracedCtx, cancel, appliedTimeout, rpcErr := withTraceTimeout(ctx, traceCfg)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	defer cancel()
+
+	// stop carries the reason tracedCtx ended (its deadline, the caller
+	// disconnecting, or the request finishing normally via cancel() above)
+	// to a running JS tracer, the same way go-ethereum's tracer Stop(err)
+	// hook aborts mid-execution with the triggering error rather than an
+	// unadorned done signal.
+	stop := make(chan error, 1)
+	go func() {
+		<-tracedCtx.Done()
+		stop <- tracedCtx.Err()
+	}()
+
+	stateTraceConfig := state.TraceConfig{
+		DisableStack:     traceCfg.DisableStack,
+		DisableStorage:   traceCfg.DisableStorage,
+		EnableMemory:     traceCfg.EnableMemory,
+		EnableReturnData: traceCfg.EnableReturnData,
+		Tracer:           traceCfg.Tracer,
+		TracerConfig:     traceCfg.TracerConfig,
+		Reexec:           traceCfg.Reexec,
+		// JSHooks tells the state layer which of the optional hooks the
+		// tracer actually defines, so it only wires up step/enter/exit/
+		// setup when present instead of calling into a JS function that
+		// doesn't exist.
+		JSHooks: jsHooks,
+		Stop:    stop,
+	}
+
+	result, err := d.state.DebugTraceCall(tracedCtx, sender, tx, blockNumber, stateOverrides, blockOverride, stateTraceConfig, dbTx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rpcErrorResponse(types.DefaultErrorCode, traceTimeoutErrorMessage(appliedTimeout), nil)
+	} else if errors.Is(err, state.ErrNotFound) || errors.Is(err, state.ErrUnsupportedTracer) {
+		// the block may be older than this node's pruned state, or the
+		// tracer isn't implemented by our executor: hand the original
+		// request to the upstream archive/tracing node.
+		if d.fallbackClient.allowsMethod(fallbackMethod) {
+			return d.dispatchToFallback(fallbackMethod, args, blockNrOrHash, cfg)
+		}
+		if errors.Is(err, state.ErrNotFound) {
+			return rpcErrorResponse(types.DefaultErrorCode, fmt.Sprintf("block #%d not found", blockNumber), nil)
+		}
+		return rpcErrorResponse(types.DefaultErrorCode, "tracer not supported", err)
+	} else if err != nil {
+		const errorMessage = "failed to get trace"
+		log.Errorf("%v: %v", errorMessage, err)
+		return nil, types.NewRPCError(types.DefaultErrorCode, errorMessage)
+	}
+
+	if stateTraceConfig.Tracer != nil && *stateTraceConfig.Tracer != "" && len(result.ExecutorTraceResult) > 0 {
+		return result.ExecutorTraceResult, nil
+	}
+
+	var returnValue interface{}
+	if stateTraceConfig.EnableReturnData {
+		returnValue = common.Bytes2Hex(result.ReturnValue)
+	}
+
+	resp := traceTransactionResponse{
+		Gas:         result.GasUsed,
+		Failed:      result.Failed(),
+		ReturnValue: returnValue,
+		StructLogs:  d.buildStructLogs(result.StructLogs, *traceCfg),
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,127 @@
+package jsonrpc
+
+import "testing"
+
+func TestTokenizeJS(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{name: "empty source", src: ""},
+		{name: "line comment is skipped", src: "// {result: fault}\n{}"},
+		{name: "block comment is skipped", src: "/* { */ {} /* } */"},
+		{name: "unterminated block comment", src: "/* never closed", wantErr: true},
+		{name: "single-quoted string with escape", src: "{result: 'it\\'s fine'}"},
+		{name: "double-quoted string", src: `{result: "ok"}`},
+		{name: "backtick template string", src: "{result: `ok`}"},
+		{name: "unterminated string literal", src: "{result: 'unterminated", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tokenizeJS(tt.src)
+			if tt.wantErr && err == nil {
+				t.Fatalf("tokenizeJS(%q) = nil error, want one", tt.src)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("tokenizeJS(%q) = %v, want no error", tt.src, err)
+			}
+		})
+	}
+}
+
+func TestTokenizeJSIgnoresHooksInsideCommentsAndStrings(t *testing.T) {
+	tokens, err := tokenizeJS("{ /* result: function(){} */ fault: 'result: function(){}' }")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tok := range tokens {
+		if tok.kind == jsTokenIdent && tok.value == "result" {
+			t.Fatal("tokenizeJS must not emit idents that only appear inside a comment or string")
+		}
+	}
+}
+
+func TestParseJSCustomTracer(t *testing.T) {
+	tests := []struct {
+		name      string
+		tracer    string
+		wantErr   bool
+		wantHooks map[string]bool
+	}{
+		{
+			name:      "minimal valid tracer",
+			tracer:    "{result: function(){}, fault: function(){}}",
+			wantHooks: map[string]bool{"result": true, "fault": true},
+		},
+		{
+			name:   "tracer with every optional hook",
+			tracer: "{step: function(){}, enter: function(){}, exit: function(){}, setup: function(){}, result: function(){}, fault: function(){}}",
+			wantHooks: map[string]bool{
+				"step": true, "enter": true, "exit": true, "setup": true, "result": true, "fault": true,
+			},
+		},
+		{
+			name:    "missing fault is rejected",
+			tracer:  "{result: function(){}}",
+			wantErr: true,
+		},
+		{
+			name:    "missing result is rejected",
+			tracer:  "{fault: function(){}}",
+			wantErr: true,
+		},
+		{
+			name:    "non-function result is rejected",
+			tracer:  "{result: 1, fault: function(){}}",
+			wantErr: true,
+		},
+		{
+			name:    "malformed source is rejected",
+			tracer:  "{result: function(){}, fault: 'unterminated",
+			wantErr: true,
+		},
+		{
+			name:   "hook mentioned only inside a nested function body doesn't count as top-level",
+			tracer: "{result: function(){ var o = {step: function(){}}; }, fault: function(){}}",
+			wantHooks: map[string]bool{"result": true, "fault": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks, err := parseJSCustomTracer(tt.tracer)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseJSCustomTracer(%q) = nil error, want one", tt.tracer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJSCustomTracer(%q) unexpected error: %v", tt.tracer, err)
+			}
+			if len(hooks) != len(tt.wantHooks) {
+				t.Fatalf("parseJSCustomTracer(%q) hooks = %v, want %v", tt.tracer, hooks, tt.wantHooks)
+			}
+			for hook := range tt.wantHooks {
+				if !hooks[hook] {
+					t.Errorf("parseJSCustomTracer(%q) missing expected hook %q", tt.tracer, hook)
+				}
+			}
+		})
+	}
+}
+
+func TestIsJSCustomTracer(t *testing.T) {
+	if !isJSCustomTracer("{result: function(){}, fault: function(){}}") {
+		t.Error("expected a minimal valid tracer to be recognized")
+	}
+	if isJSCustomTracer("{result: function(){}}") {
+		t.Error("a tracer missing fault must not be recognized")
+	}
+	if isJSCustomTracer("not even an object literal") {
+		t.Error("plain text must not be recognized as a tracer")
+	}
+}